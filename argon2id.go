@@ -0,0 +1,110 @@
+// argon2id.go
+//
+// Argon2id support, offered alongside bcrypt as a configurable password
+// hash (hash_algo = bcrypt|argon2id). Argon2id hashes are stored with a
+// self-describing prefix, e.g.
+//
+//   $argon2id$v=19$m=65536,t=3,p=2$<b64 salt>$<b64 hash>
+//
+// so check_hash() (see authlite.go) can verify against whichever
+// algorithm actually produced a given stored hash, independent of the
+// currently configured default. That's what lets an operator flip
+// hash_algo and have existing users migrate gradually: csvAuthenticator
+// (see backend.go) re-hashes with the new algorithm on their next
+// successful login rather than requiring a bulk migration.
+//
+// 2020-05-18
+
+package authlite
+
+import( "crypto/rand"; "crypto/subtle"; "encoding/base64"; "fmt"; "strings";
+        "golang.org/x/crypto/argon2"; "golang.org/x/crypto/bcrypt" )
+
+const argon2_hash_len = 32
+const argon2_salt_len = 16
+
+// hash_algo selects the password hash used for newly-set passwords
+// (AddUser(), and re-hash-on-login); "bcrypt" or "argon2id".
+var hash_algo string = "bcrypt"
+var argon2_memory_kib int = 65536
+var argon2_time        int = 3
+var argon2_parallelism int = 2
+
+// hash_password() hashes pwd with whichever algorithm hash_algo selects.
+//
+func hash_password(pwd string) ([]byte, error) {
+    switch hash_algo {
+    case "", "bcrypt":
+        return bcrypt.GenerateFromPassword([]byte(pwd), hash_cost)
+    case "argon2id":
+        return hash_argon2id(pwd)
+    default:
+        return nil, fmt.Errorf("unrecognized hash_algo %q", hash_algo)
+    }
+}
+
+// hash_argon2id() produces a self-describing argon2id hash string for
+// pwd, using the configured argon2_memory_kib/argon2_time/argon2_parallelism
+// and a fresh random salt.
+//
+func hash_argon2id(pwd string) ([]byte, error) {
+    salt := make([]byte, argon2_salt_len)
+    if _, err := rand.Read(salt); err != nil {
+        return nil, fmt.Errorf("error generating salt: %s", err.Error())
+    }
+
+    sum := argon2.IDKey([]byte(pwd), salt, uint32(argon2_time), uint32(argon2_memory_kib), uint8(argon2_parallelism), argon2_hash_len)
+
+    encoded := fmt.Sprintf("$argon2id$v=19$m=%d,t=%d,p=%d$%s$%s",
+        argon2_memory_kib, argon2_time, argon2_parallelism,
+        base64.RawStdEncoding.EncodeToString(salt),
+        base64.RawStdEncoding.EncodeToString(sum))
+    return []byte(encoded), nil
+}
+
+// check_argon2id() verifies pwd against a stored "$argon2id$..." hash
+// string, using the parameters and salt recorded in the hash itself
+// (not the currently configured ones, so old hashes keep verifying
+// after a config change).
+//
+func check_argon2id(stored, pwd string) (bool, error) {
+    parts := strings.Split(stored, "$")
+    if len(parts) != 6 {
+        return false, fmt.Errorf("malformed argon2id hash")
+    }
+
+    var m, t uint32
+    var p uint8
+    if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &m, &t, &p); err != nil {
+        return false, fmt.Errorf("malformed argon2id parameters %q: %s", parts[3], err.Error())
+    }
+    salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+    if err != nil {
+        return false, fmt.Errorf("malformed argon2id salt: %s", err.Error())
+    }
+    want, err := base64.RawStdEncoding.DecodeString(parts[5])
+    if err != nil {
+        return false, fmt.Errorf("malformed argon2id digest: %s", err.Error())
+    }
+
+    got := argon2.IDKey([]byte(pwd), salt, t, m, p, uint32(len(want)))
+    if subtle.ConstantTimeCompare(got, want) == 1 {
+        return true, nil
+    }
+    return false, ErrBadPassword
+}
+
+// hash_needs_rehash() reports whether hsh was produced by an algorithm
+// other than the currently configured hash_algo.
+//
+func hash_needs_rehash(hsh []byte) bool {
+    is_argon2id := strings.HasPrefix(string(hsh), "$argon2id$")
+    switch hash_algo {
+    case "", "bcrypt":
+        return is_argon2id
+    case "argon2id":
+        return !is_argon2id
+    default:
+        return false
+    }
+}
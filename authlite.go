@@ -9,8 +9,8 @@
 //
 package authlite
 
-import( "encoding/csv"; "errors"; "fmt"; "io/ioutil"; "log"; "math/rand";
-        "os"; "strconv"; "sync"; "time";
+import( "bytes"; "crypto/rand"; "encoding/csv"; "errors"; "fmt"; "io/ioutil"; "log";
+        "os"; "strconv"; "strings"; "sync"; "time";
         "golang.org/x/crypto/bcrypt";
         "github.com/d2718/dconfig";
 )
@@ -20,6 +20,13 @@ const DEBUG bool = false
 // This one sync.Mutex protects both files.
 var file_mu *sync.Mutex
 var hash_file, key_file string
+// If store_passphrase_env is set, hash_file and key_file are encrypted at
+// rest; see crypt_store.go.
+var store_passphrase_env string
+var store_kdf            string
+// If resilient_store is set, hash_file and key_file are wrapped in the
+// Reed-Solomon record format from rs_store.go.
+var resilient_store bool
 // None of these four are protected by mutices because they should only ever be
 // changed during the explicitly-non-thread-safe Configure().
 var key_length   int = 32
@@ -97,7 +104,11 @@ func ensure_exists_writably(path string) error {
 
 // hash_file format:
 //
-// uname,hashed_pwd_as_string
+// uname,hashed_pwd_as_string[,mfa_method,mfa_secret,mfa_counter]
+//
+// The three mfa_* fields are optional for backward compatibility with
+// hash files written before two-factor support existed; a row missing
+// them is treated as mfa_method "none". See totp.go.
 
 // LoadUsers() attempts to load username/password hash data from the file
 // specified in the USER_FILE configuation option. If current user data
@@ -114,38 +125,34 @@ func LoadUsers() error {
     }
     
     file_mu.Lock()
-    f, err := os.Open(hash_file)
+    raw, err := read_store_file(hash_file)
+    file_mu.Unlock()
     if err != nil {
-        file_mu.Unlock()
-        return fmt.Errorf("Unable to open user file %q for reading: %s", hash_file, err.Error())
+        return fmt.Errorf("Unable to read user file %q: %s", hash_file, err.Error())
     }
-    
-    r := csv.NewReader(f)
-    
+
+    r := csv.NewReader(bytes.NewReader(raw))
+    r.FieldsPerRecord = -1
+
     recs, err := r.ReadAll()
     if err != nil {
-        f.Close()
-        file_mu.Unlock()
         return fmt.Errorf("Error reading from user file %q: %s", hash_file, err.Error())
     }
-    err = f.Close()
-    file_mu.Unlock()
-    if err != nil {
-        return fmt.Errorf("Error closing user file %q: %s", hash_file, err.Error())
-    }
-    
+
     umu.Lock()
     defer umu.Unlock()
     users = make(map[string][]byte)
+    mfa = make(map[string]mfaRecord)
     for _, r := range recs {
         if len(r) < 2 {
             return fmt.Errorf("User file %q has unreadable format.", hash_file)
         }
         users[r[0]] = []byte(r[1])
+        mfa[r[0]] = mfa_record_from_fields(r)
     }
     log.Printf("Loaded %d users.", len(users))
     udirty = false
-    
+
     return nil
 }
 
@@ -161,38 +168,30 @@ func FlushUsers() error {
     }
     
     umu.Lock()
-    file_mu.Lock()
-    defer file_mu.Unlock()
     defer umu.Unlock()
-    
-    f, err := os.OpenFile(hash_file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 644)
-    if err != nil {
-        return fmt.Errorf("Error opening user file %q for writing: %s", hash_file, err.Error())
-    }
-    
-    w := csv.NewWriter(f)
+
+    var buf bytes.Buffer
+    w := csv.NewWriter(&buf)
     var n_written int = 0
     for uname, phash := range users {
-        err = w.Write([]string{ uname, string(phash) })
+        err := w.Write(mfa_record_to_fields(uname, string(phash), mfa[uname]))
         if err != nil {
-            f.Close()
             return fmt.Errorf("Error writing to user file %q: %s", hash_file, err.Error())
         }
         n_written++
     }
-    
     w.Flush()
-    err = w.Error()
-    if err != nil {
-        f.Close()
+    if err := w.Error(); err != nil {
         return fmt.Errorf("Error flushing user file %q to disk: %s", hash_file, err.Error())
     }
-    
-    err = f.Close()
+
+    file_mu.Lock()
+    err := write_store_file(hash_file, buf.Bytes())
+    file_mu.Unlock()
     if err != nil {
-        return fmt.Errorf("Error closing user file %q: %s", hash_file, err.Error())
+        return fmt.Errorf("Error writing user file %q: %s", hash_file, err.Error())
     }
-    
+
     log.Printf("Wrote %d users.", n_written)
     udirty = false
     return nil
@@ -215,25 +214,18 @@ func LoadKeys() error {
     }
     
     file_mu.Lock()
-    f, err := os.Open(key_file)
+    raw, err := read_store_file(key_file)
+    file_mu.Unlock()
     if err != nil {
-        file_mu.Unlock()
-        return fmt.Errorf("Error opening key file %q for read: %s", key_file, err.Error())
+        return fmt.Errorf("Error reading key file %q: %s", key_file, err.Error())
     }
-    
-    r := csv.NewReader(f)
+
+    r := csv.NewReader(bytes.NewReader(raw))
     recs, err := r.ReadAll()
     if err != nil {
-        f.Close()
-        file_mu.Unlock()
         return fmt.Errorf("Error reading key file %q: %s", key_file, err.Error())
     }
-    err = f.Close()
-    file_mu.Unlock()
-    if err != nil {
-        return fmt.Errorf("Error closing key file %q: %s", key_file, err.Error())
-    }
-    
+
     now := time.Now()
     kmu.Lock()
     defer kmu.Unlock()
@@ -264,34 +256,34 @@ func FlushKeys() error {
         return fmt.Errorf("No KEY_FILE set. Try calling Configure() first.")
     }
     
-    file_mu.Lock()
-    f, err := os.OpenFile(key_file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 644)
-    defer file_mu.Unlock()
-    if err != nil {
-        return fmt.Errorf("Error opening key file %q for writing: %s", key_file, err.Error())
-    }
-    
-    w := csv.NewWriter(f)
-    
+    var buf bytes.Buffer
+    w := csv.NewWriter(&buf)
+
     now := time.Now()
     var n_written int = 0
     kmu.Lock()
     defer kmu.Unlock()
     for k, v := range keys {
         if v.until.After(now) {
-            err = w.Write([]string{ v.uname, fmt.Sprintf("%d", v.until.Unix()), k })
+            err := w.Write([]string{ v.uname, fmt.Sprintf("%d", v.until.Unix()), k })
             if err != nil {
-                f.Close()
                 return fmt.Errorf("Error writing to key file %q: %s", key_file, err.Error())
             }
             n_written++
         }
     }
     w.Flush()
-    err = f.Close()
+    if err := w.Error(); err != nil {
+        return fmt.Errorf("Error flushing key file %q to disk: %s", key_file, err.Error())
+    }
+
+    file_mu.Lock()
+    err := write_store_file(key_file, buf.Bytes())
+    file_mu.Unlock()
     if err != nil {
-        return fmt.Errorf("Error closing key file %q: %s", key_file, err.Error())
+        return fmt.Errorf("Error writing key file %q: %s", key_file, err.Error())
     }
+
     log.Printf("Wrote %d keys.", n_written)
     kdirty = false
     return nil
@@ -312,13 +304,24 @@ func Configure(cfg_path string) error {
     
     var key_char_str string = string(key_runes)
     var key_life_cfg_int int = 600
+    var auth_backend_cfg string = "csv"
+    var resilient_store_cfg int = 0
+    var hash_algo_cfg string = "bcrypt"
     dconfig.Reset()
-    dconfig.AddString(&hash_file,     "user_file",    dconfig.STRIP)
-    dconfig.AddString(&key_file,      "key_file",     dconfig.STRIP)
-    dconfig.AddInt(&key_length,       "key_length",   dconfig.UNSIGNED)
-    dconfig.AddString(&key_char_str,  "key_chars",    dconfig.STRIP)
-    dconfig.AddInt(&hash_cost,        "hash_cost",    dconfig.UNSIGNED)
-    dconfig.AddInt(&key_life_cfg_int, "key_lifetime", dconfig.UNSIGNED)
+    dconfig.AddString(&hash_file,       "user_file",    dconfig.STRIP)
+    dconfig.AddString(&key_file,        "key_file",     dconfig.STRIP)
+    dconfig.AddInt(&key_length,         "key_length",   dconfig.UNSIGNED)
+    dconfig.AddString(&key_char_str,    "key_chars",    dconfig.STRIP)
+    dconfig.AddInt(&hash_cost,          "hash_cost",    dconfig.UNSIGNED)
+    dconfig.AddInt(&key_life_cfg_int,   "key_lifetime", dconfig.UNSIGNED)
+    dconfig.AddString(&auth_backend_cfg,"auth_backend", dconfig.STRIP)
+    dconfig.AddString(&store_passphrase_env, "store_passphrase_env", dconfig.STRIP)
+    dconfig.AddString(&store_kdf,       "store_kdf",    dconfig.STRIP)
+    dconfig.AddInt(&resilient_store_cfg,"resilient_store", dconfig.UNSIGNED)
+    dconfig.AddString(&hash_algo_cfg,   "hash_algo",    dconfig.STRIP)
+    dconfig.AddInt(&argon2_memory_kib,  "argon2_memory_kib", dconfig.UNSIGNED)
+    dconfig.AddInt(&argon2_time,        "argon2_time",  dconfig.UNSIGNED)
+    dconfig.AddInt(&argon2_parallelism, "argon2_parallelism", dconfig.UNSIGNED)
     err := dconfig.Configure([]string{cfg_path}, true)
     if err != nil {
         log.Printf("dconfig.Configure(...) returned error: %s", err.Error())
@@ -339,10 +342,32 @@ func Configure(cfg_path string) error {
     if err != nil {
         return fmt.Errorf("error with key file: %s", err.Error())
     }
-    
+
+    if store_kdf == "" {
+        store_kdf = "scrypt"
+    } else if store_kdf != "scrypt" {
+        return fmt.Errorf("unsupported store_kdf %q (only \"scrypt\" is supported)", store_kdf)
+    }
+
+    switch hash_algo_cfg {
+    case "", "bcrypt", "argon2id":
+        hash_algo = hash_algo_cfg
+    default:
+        return fmt.Errorf("unsupported hash_algo %q (want bcrypt or argon2id)", hash_algo_cfg)
+    }
+
     key_runes = []rune(key_char_str)
+    if len(key_runes) == 0 {
+        return fmt.Errorf("key_chars must not be empty")
+    }
     key_lifetime = time.Duration(time.Duration(key_life_cfg_int) * time.Second)
-    
+    resilient_store = resilient_store_cfg != 0
+
+    err = set_auth_backend(auth_backend_cfg)
+    if err != nil {
+        return fmt.Errorf("error configuring auth_backend: %s", err.Error())
+    }
+
     err = LoadUsers()
     if err != nil {
         return fmt.Errorf("Error loading users: %s", err.Error())
@@ -355,11 +380,25 @@ func Configure(cfg_path string) error {
     return nil
 }
 
+// generate_key() draws key_length runes from key_runes using crypto/rand,
+// rejection-sampling each byte so that every rune is equally likely
+// (naive `b % len(key_runes)` would bias low indices whenever
+// len(key_runes) doesn't evenly divide 256).
+//
 func generate_key() string {
     max_n := len(key_runes)
+    limit := 256 - (256 % max_n)
     k := make([]rune, key_length)
-    for n := 0; n < key_length; n++ {
-        k[n] = key_runes[rand.Intn(max_n)]
+    var buf [1]byte
+    for n := 0; n < key_length; {
+        if _, err := rand.Read(buf[:]); err != nil {
+            log.Printf("crypto/rand.Read(...) returned error: %s", err.Error())
+            continue
+        }
+        if int(buf[0]) < limit {
+            k[n] = key_runes[int(buf[0])%max_n]
+            n++
+        }
     }
     return string(k)
 }
@@ -375,14 +414,15 @@ func AddUser(uname, pwd string) error {
         return ErrUserExists
     }
     
-    pwd_hsh, err := bcrypt.GenerateFromPassword([]byte(pwd), hash_cost)
+    pwd_hsh, err := hash_password(pwd)
     if err != nil {
         return fmt.Errorf("Unable to hash password: %s", err.Error())
     }
     
     users[uname] = pwd_hsh
+    mfa[uname] = mfaRecord{ Method: "none" }
     udirty = true
-    
+
     return nil
 }
 // DeleteUser() removes the user with the supplied user name. Will return
@@ -394,6 +434,7 @@ func DeleteUser(uname string) error {
     defer umu.Unlock()
     if _, exists := users[uname]; exists {
         delete(users, uname)
+        delete(mfa, uname)
         udirty = true
         return nil
     } else {
@@ -401,16 +442,9 @@ func DeleteUser(uname string) error {
     }
 }
 
-// CheckPassword() returns whether the supplied username/password combo
-// checks out. Will return ErrNotAUser or ErrBadPassword as appropriate.
+// check_bcrypt() compares pwd against a stored bcrypt hash.
 //
-func CheckPassword(uname, pwd string) (bool, error) {
-    umu.RLock()
-    hsh, exists := users[uname]
-    umu.RUnlock()
-    if !exists {
-        return false, ErrNotAUser
-    }
+func check_bcrypt(hsh []byte, pwd string) (bool, error) {
     err := bcrypt.CompareHashAndPassword(hsh, []byte(pwd))
     if err == nil {
         return true, nil
@@ -420,6 +454,20 @@ func CheckPassword(uname, pwd string) (bool, error) {
     }
 }
 
+// check_hash() compares pwd against a stored password hash, dispatching
+// on the hash's self-describing prefix (argon2id hashes start with
+// "$argon2id$"; anything else is assumed to be bcrypt) so CSV files can
+// hold a mix of both while a fleet migrates from one to the other. It
+// backs the default CSV Authenticator (see backend.go); CheckPassword()
+// itself now dispatches through whatever Authenticator is configured.
+//
+func check_hash(hsh []byte, pwd string) (bool, error) {
+    if strings.HasPrefix(string(hsh), "$argon2id$") {
+        return check_argon2id(string(hsh), pwd)
+    }
+    return check_bcrypt(hsh, pwd)
+}
+
 // CheckKey() Checks to see whether the supplied key has been issued to
 // the supplied username and has not expired. Returns ErrBadKey on failure.
 //
@@ -505,6 +553,4 @@ func init() {
     file_mu = new(sync.Mutex)
     umu = new(sync.RWMutex)
     kmu = new(sync.RWMutex)
-    
-    rand.Seed(time.Now().UnixNano())
 }
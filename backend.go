@@ -0,0 +1,110 @@
+// backend.go
+//
+// Pluggable authentication backends. By default authlite checks passwords
+// against the bcrypt or argon2id hashes it loads from the user file (USER_FILE), but
+// an operator may instead want to delegate to an existing source of truth
+// (system users, an upstream directory, etc). Authenticator is the
+// extension point that makes that possible.
+//
+// 2020-02-11
+
+package authlite
+
+import( "fmt"; "log" )
+
+// Authenticator is the interface any authentication backend must satisfy.
+// Check() should return (true, nil) on a good username/password combo,
+// and (false, err) otherwise, where err is one of the package's sentinel
+// errors (ErrNotAUser, ErrBadPassword) when applicable.
+//
+type Authenticator interface {
+    Check(uname, pwd string) (bool, error)
+}
+
+// the backend currently in use; defaults to the CSV/bcrypt store so
+// existing callers see no change in behavior.
+var auth_backend Authenticator = csvAuthenticator{}
+
+// csvAuthenticator is the original CheckPassword() behavior, pulled out
+// so it can be selected (or chained) like any other Authenticator.
+//
+type csvAuthenticator struct{}
+
+func (csvAuthenticator) Check(uname, pwd string) (bool, error) {
+    umu.RLock()
+    hsh, exists := users[uname]
+    umu.RUnlock()
+    if !exists {
+        return false, ErrNotAUser
+    }
+
+    ok, err := check_hash(hsh, pwd)
+    if !ok {
+        return false, err
+    }
+
+    if hash_needs_rehash(hsh) {
+        // migrate this user to the currently configured hash_algo now
+        // that we know their password; best-effort, failure here
+        // shouldn't fail the login that's already succeeded.
+        if new_hsh, err := hash_password(pwd); err == nil {
+            umu.Lock()
+            users[uname] = new_hsh
+            udirty = true
+            umu.Unlock()
+        } else {
+            log.Printf("error re-hashing password for %q: %s", uname, err.Error())
+        }
+    }
+
+    return true, nil
+}
+
+// chainAuthenticator tries each of its backends in order, returning the
+// first success. If none succeed, it returns the error from the last
+// backend tried.
+//
+type chainAuthenticator struct {
+    backends []Authenticator
+}
+
+func (c chainAuthenticator) Check(uname, pwd string) (bool, error) {
+    var err error
+    for _, b := range c.backends {
+        var ok bool
+        ok, err = b.Check(uname, pwd)
+        if ok {
+            return true, nil
+        }
+    }
+    return false, err
+}
+
+// set_auth_backend() is called by Configure() (see authlite.go) once the
+// "auth_backend" option has been read; name should be one of "csv",
+// "shadow", or "chain".
+//
+func set_auth_backend(name string) error {
+    switch name {
+    case "", "csv":
+        auth_backend = csvAuthenticator{}
+    case "shadow":
+        auth_backend = new_shadow_authenticator()
+    case "chain":
+        auth_backend = chainAuthenticator{
+            backends: []Authenticator{ new_shadow_authenticator(), csvAuthenticator{} },
+        }
+    default:
+        return fmt.Errorf("unrecognized auth_backend %q (want csv, shadow, or chain)", name)
+    }
+    return nil
+}
+
+// CheckPassword() returns whether the supplied username/password combo
+// checks out, dispatching to whichever Authenticator is configured (see
+// the "auth_backend" Configure() option). Will return ErrNotAUser or
+// ErrBadPassword as appropriate.
+//
+func CheckPassword(uname, pwd string) (bool, error) {
+    return auth_backend.Check(uname, pwd)
+}
@@ -0,0 +1,152 @@
+// crypt_store.go
+//
+// Optional encryption-at-rest for hash_file and key_file, so the CSV
+// data (password hashes, session keys) isn't sitting in the clear on a
+// shared disk. Enabled by setting the "store_passphrase_env" Configure()
+// option to the name of an environment variable holding the passphrase;
+// a 32-byte key is derived from it with scrypt and the CSV payload is
+// sealed with NaCl secretbox (XSalsa20-Poly1305).
+//
+// Files written by LoadUsers()/FlushUsers()/LoadKeys()/FlushKeys() (see
+// authlite.go) before this feature existed are plain CSV; we recognize
+// them by the absence of store_magic and read them as before, so
+// existing deployments keep working untouched.
+//
+// 2020-04-06
+
+package authlite
+
+import( "bytes"; "crypto/rand"; "fmt"; "io/ioutil"; "os";
+        "golang.org/x/crypto/nacl/secretbox"; "golang.org/x/crypto/scrypt" )
+
+// store_magic prefixes an encrypted container so read_store_file() can
+// tell it apart from a plain (unencrypted, pre-existing-format) CSV file.
+var store_magic = []byte("AUTHLITE-ENC1\n")
+
+const store_salt_len  = 16
+const store_nonce_len = 24
+
+// read_store_file() reads path, undoing whichever optional on-disk
+// layers are in play: encryption (see store_passphrase_env, above), then
+// the Reed-Solomon resilient record format (see rs_store.go). A file
+// written before either feature existed is plain CSV and is returned
+// as-is.
+//
+func read_store_file(path string) ([]byte, error) {
+    raw, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+
+    payload := raw
+    if bytes.HasPrefix(raw, store_magic) {
+        payload, err = decrypt_store(raw)
+        if err != nil {
+            return nil, err
+        }
+    }
+    if bytes.HasPrefix(payload, rs_magic) {
+        payload, err = rs_decode_store(payload)
+        if err != nil {
+            return nil, fmt.Errorf("error recovering resilient store %q: %s", path, err.Error())
+        }
+    }
+    return payload, nil
+}
+
+// write_store_file() writes plaintext to path, first wrapping it in the
+// Reed-Solomon resilient record format if resilient_store is configured,
+// then encrypting it if store_passphrase_env is configured.
+//
+func write_store_file(path string, plaintext []byte) error {
+    payload := plaintext
+    if resilient_store {
+        payload = rs_encode_store(payload)
+    }
+    if store_passphrase_env != "" {
+        sealed, err := encrypt_store(payload)
+        if err != nil {
+            return err
+        }
+        payload = sealed
+    }
+    return ioutil.WriteFile(path, payload, 0600)
+}
+
+// decrypt_store() unwraps an encrypted container (store_magic + salt +
+// nonce + sealed payload) using store_passphrase_env.
+//
+func decrypt_store(raw []byte) ([]byte, error) {
+    body := raw[len(store_magic):]
+    if len(body) < store_salt_len+store_nonce_len {
+        return nil, fmt.Errorf("encrypted store is truncated")
+    }
+    salt  := body[:store_salt_len]
+    var nonce [store_nonce_len]byte
+    copy(nonce[:], body[store_salt_len:store_salt_len+store_nonce_len])
+    ciphertext := body[store_salt_len+store_nonce_len:]
+
+    dk, err := derive_store_key(salt)
+    if err != nil {
+        return nil, err
+    }
+    defer zero_bytes(dk[:])
+
+    plaintext, ok := secretbox.Open(nil, ciphertext, &nonce, dk)
+    if !ok {
+        return nil, fmt.Errorf("unable to decrypt store: bad passphrase or corrupt file")
+    }
+    return plaintext, nil
+}
+
+// encrypt_store() wraps plaintext in an encrypted container using
+// store_passphrase_env: store_magic, a random salt, a random nonce, and
+// the secretbox-sealed payload, in that order.
+//
+func encrypt_store(plaintext []byte) ([]byte, error) {
+    salt := make([]byte, store_salt_len)
+    if _, err := rand.Read(salt); err != nil {
+        return nil, fmt.Errorf("error generating salt: %s", err.Error())
+    }
+    var nonce [store_nonce_len]byte
+    if _, err := rand.Read(nonce[:]); err != nil {
+        return nil, fmt.Errorf("error generating nonce: %s", err.Error())
+    }
+
+    dk, err := derive_store_key(salt)
+    if err != nil {
+        return nil, err
+    }
+    defer zero_bytes(dk[:])
+
+    sealed := secretbox.Seal(nil, plaintext, &nonce, dk)
+
+    var out bytes.Buffer
+    out.Write(store_magic)
+    out.Write(salt)
+    out.Write(nonce[:])
+    out.Write(sealed)
+    return out.Bytes(), nil
+}
+
+// derive_store_key() reads the passphrase out of the environment
+// variable named by store_passphrase_env and derives a 32-byte
+// secretbox key from it and salt using scrypt (N=32768, r=8, p=1). The
+// passphrase is zeroed before returning.
+//
+func derive_store_key(salt []byte) (*[32]byte, error) {
+    passphrase := []byte(os.Getenv(store_passphrase_env))
+    if len(passphrase) == 0 {
+        return nil, fmt.Errorf("environment variable %q (store_passphrase_env) is unset or empty", store_passphrase_env)
+    }
+    defer zero_bytes(passphrase)
+
+    raw, err := scrypt.Key(passphrase, salt, 32768, 8, 1, 32)
+    if err != nil {
+        return nil, fmt.Errorf("error deriving store key: %s", err.Error())
+    }
+    var dk [32]byte
+    copy(dk[:], raw)
+    zero_bytes(raw)
+    return &dk, nil
+}
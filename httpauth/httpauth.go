@@ -0,0 +1,340 @@
+// httpauth.go
+//
+// A thin net/http layer on top of authlite's session-key primitives, so
+// a small web app can drop authlite in directly instead of wiring its
+// own cookie/CSRF/rate-limiting plumbing around CheckPasswordAndIssueKey
+// and CheckAndRefreshKey.
+//
+// https://github.com/d2718/authlite
+//
+// 2020-07-09
+
+package httpauth
+
+import( "context"; "crypto/hmac"; "crypto/rand"; "crypto/sha256"; "crypto/subtle";
+        "encoding/hex"; "net"; "net/http"; "strings"; "sync"; "time";
+        "github.com/d2718/authlite" )
+
+// CookieName is the name of the session cookie set by LoginHandler() and
+// read by RequireAuth().
+var CookieName = "authlite_session"
+
+// CSRFCookieName is the name of the double-submit CSRF cookie.
+var CSRFCookieName = "authlite_csrf"
+
+// CookieSecure controls the Secure flag on both cookies LoginHandler()
+// sets. Leave this true in production (it requires HTTPS); you'll only
+// want it false for local HTTP development.
+var CookieSecure = true
+
+// CookieSameSite controls the SameSite flag on both cookies.
+var CookieSameSite = http.SameSiteLaxMode
+
+// SigningKey authenticates the session cookie's contents (so a client
+// can't, say, graft their own key onto someone else's username) with
+// HMAC-SHA256. Callers MUST set this to a long random value before
+// serving any requests; it is not generated automatically because it
+// needs to stay stable across restarts. RequireAuth() and LoginHandler()
+// refuse to serve requests (500) while this is unset, rather than
+// silently signing cookies with an empty key.
+var SigningKey []byte
+
+type ctx_key int
+
+const username_ctx_key ctx_key = 0
+
+// UsernameFromContext() extracts the username RequireAuth() attached to
+// an authenticated request's context.
+//
+func UsernameFromContext(ctx context.Context) (string, bool) {
+    uname, ok := ctx.Value(username_ctx_key).(string)
+    return uname, ok
+}
+
+// RequireAuth() wraps h, rejecting any request that doesn't carry a
+// valid session cookie with 401 Unauthorized, and otherwise refreshing
+// the key's expiry (via authlite.CheckAndRefreshKey()) and attaching the
+// username to the request's context for h to read back out with
+// UsernameFromContext().
+//
+func RequireAuth(h http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if len(SigningKey) == 0 {
+            http.Error(w, "internal error", http.StatusInternalServerError)
+            return
+        }
+        c, err := r.Cookie(CookieName)
+        if err != nil {
+            http.Error(w, "unauthorized", http.StatusUnauthorized)
+            return
+        }
+        uname, keystr, ok := parse_cookie_value(c.Value)
+        if !ok {
+            http.Error(w, "unauthorized", http.StatusUnauthorized)
+            return
+        }
+        ok, err = authlite.CheckAndRefreshKey(uname, keystr)
+        if !ok {
+            http.Error(w, "unauthorized", http.StatusUnauthorized)
+            return
+        }
+        ctx := context.WithValue(r.Context(), username_ctx_key, uname)
+        h.ServeHTTP(w, r.WithContext(ctx))
+    })
+}
+
+// LoginHandler() handles both halves of the login flow: a GET issues a
+// fresh CSRF cookie for the login form to embed; a POST validates the
+// CSRF token, rate-limits by remote IP, checks the username/password
+// combo via authlite.CheckPasswordAndIssueKey(), and on success sets the
+// session cookie.
+//
+func LoginHandler(w http.ResponseWriter, r *http.Request) {
+    if len(SigningKey) == 0 {
+        http.Error(w, "internal error", http.StatusInternalServerError)
+        return
+    }
+
+    switch r.Method {
+    case http.MethodGet:
+        issue_csrf_cookie(w)
+        return
+    case http.MethodPost:
+        // falls through
+    default:
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    if !login_limiter.Allow(client_ip(r)) {
+        http.Error(w, "too many login attempts; try again later", http.StatusTooManyRequests)
+        return
+    }
+
+    if err := r.ParseForm(); err != nil {
+        http.Error(w, "bad request", http.StatusBadRequest)
+        return
+    }
+    if !valid_csrf(r) {
+        http.Error(w, "bad or missing csrf token", http.StatusForbidden)
+        return
+    }
+
+    uname := r.FormValue("username")
+    pwd   := r.FormValue("password")
+
+    kstr, err := authlite.CheckPasswordAndIssueKey(uname, pwd)
+    if err != nil {
+        http.Error(w, "bad username/password", http.StatusUnauthorized)
+        return
+    }
+
+    http.SetCookie(w, &http.Cookie{
+        Name:     CookieName,
+        Value:    sign_cookie_value(uname, kstr),
+        Path:     "/",
+        HttpOnly: true,
+        Secure:   CookieSecure,
+        SameSite: CookieSameSite,
+    })
+    w.WriteHeader(http.StatusOK)
+}
+
+// sign_cookie_value() packs uname and keystr into "uname|keystr|hmac".
+//
+func sign_cookie_value(uname, keystr string) string {
+    payload := uname + "|" + keystr
+    return payload + "|" + hex.EncodeToString(hmac_sum(payload))
+}
+
+// parse_cookie_value() is the inverse of sign_cookie_value(); it returns
+// ok=false if the signature doesn't check out.
+//
+func parse_cookie_value(v string) (uname, keystr string, ok bool) {
+    idx := strings.LastIndex(v, "|")
+    if idx < 0 {
+        return "", "", false
+    }
+    payload, sig := v[:idx], v[idx+1:]
+    want, err := hex.DecodeString(sig)
+    if err != nil || !hmac.Equal(want, hmac_sum(payload)) {
+        return "", "", false
+    }
+    parts := strings.SplitN(payload, "|", 2)
+    if len(parts) != 2 {
+        return "", "", false
+    }
+    return parts[0], parts[1], true
+}
+
+func hmac_sum(payload string) []byte {
+    mac := hmac.New(sha256.New, SigningKey)
+    mac.Write([]byte(payload))
+    return mac.Sum(nil)
+}
+
+// issue_csrf_cookie() generates a fresh CSRF token with crypto/rand,
+// sets it as the double-submit cookie, and writes it to the response
+// body so a login form can embed it in a hidden field.
+//
+func issue_csrf_cookie(w http.ResponseWriter) {
+    raw := make([]byte, 32)
+    if _, err := rand.Read(raw); err != nil {
+        http.Error(w, "internal error", http.StatusInternalServerError)
+        return
+    }
+    token := hex.EncodeToString(raw)
+
+    http.SetCookie(w, &http.Cookie{
+        Name:     CSRFCookieName,
+        Value:    token,
+        Path:     "/",
+        HttpOnly: false, // the form needs to read this back to submit it
+        Secure:   CookieSecure,
+        SameSite: CookieSameSite,
+    })
+    w.Write([]byte(token))
+}
+
+// valid_csrf() implements the double-submit check: the "csrf_token" form
+// field must match the CSRFCookieName cookie.
+//
+func valid_csrf(r *http.Request) bool {
+    c, err := r.Cookie(CSRFCookieName)
+    if err != nil {
+        return false
+    }
+    submitted := r.FormValue("csrf_token")
+    return submitted != "" && subtle.ConstantTimeCompare([]byte(submitted), []byte(c.Value)) == 1
+}
+
+// client_ip() extracts the remote IP (stripping the port) for rate
+// limiting purposes.
+//
+func client_ip(r *http.Request) string {
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        return r.RemoteAddr
+    }
+    return host
+}
+
+// login_limiter is the package-wide per-IP login rate limiter. Tune it
+// with SetLoginRateLimit() before serving requests if the defaults
+// (5 attempts, refilling 1 every 10 seconds) don't fit.
+var login_limiter = new_token_bucket_limiter(0.1, 5)
+
+// SetLoginRateLimit() configures the per-IP login rate limiter: rate is
+// the steady-state number of attempts allowed per second, burst is the
+// number of attempts that may be made immediately before the rate limit
+// kicks in.
+//
+func SetLoginRateLimit(rate, burst float64) {
+    login_limiter = new_token_bucket_limiter(rate, burst)
+}
+
+type token_bucket struct {
+    tokens float64
+    last   time.Time
+}
+
+type token_bucket_limiter struct {
+    mu      sync.Mutex
+    buckets map[string]*token_bucket
+    rate    float64
+    burst   float64
+    calls   uint64
+}
+
+// bucket_evict_every controls how often (in Allow() calls) we sweep
+// buckets map for stale entries, so it doesn't grow without bound as
+// distinct client IPs hit the login endpoint.
+const bucket_evict_every = 1000
+
+func new_token_bucket_limiter(rate, burst float64) *token_bucket_limiter {
+    return &token_bucket_limiter{
+        buckets: make(map[string]*token_bucket),
+        rate:    rate,
+        burst:   burst,
+    }
+}
+
+// Allow() reports whether a request from key (normally a remote IP) may
+// proceed, consuming a token if so.
+//
+func (l *token_bucket_limiter) Allow(key string) bool {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    now := time.Now()
+
+    l.calls++
+    if l.calls%bucket_evict_every == 0 {
+        l.evict_stale(now)
+    }
+
+    b, exists := l.buckets[key]
+    if !exists {
+        b = &token_bucket{ tokens: l.burst, last: now }
+        l.buckets[key] = b
+    } else {
+        elapsed := now.Sub(b.last).Seconds()
+        b.tokens += elapsed * l.rate
+        if b.tokens > l.burst {
+            b.tokens = l.burst
+        }
+        b.last = now
+    }
+
+    if b.tokens < 1 {
+        return false
+    }
+    b.tokens--
+    return true
+}
+
+// evict_stale() drops buckets that haven't been touched in long enough
+// that they'd be fully refilled several times over by now - they're not
+// throttling anything anymore, just holding memory. Caller must hold l.mu.
+//
+func (l *token_bucket_limiter) evict_stale(now time.Time) {
+    stale_after := 30 * time.Minute
+    if l.rate > 0 {
+        stale_after = time.Duration(4 * l.burst / l.rate * float64(time.Second))
+        if stale_after < time.Minute {
+            stale_after = time.Minute
+        }
+    }
+    for k, b := range l.buckets {
+        if now.Sub(b.last) > stale_after {
+            delete(l.buckets, k)
+        }
+    }
+}
+
+// StartKeyJanitor() launches a background goroutine that, every
+// interval, calls authlite.CullOldKeys() followed by
+// authlite.FlushKeys() to keep key_file from accumulating expired
+// entries. It returns a function that stops the goroutine.
+//
+func StartKeyJanitor(interval time.Duration) (stop func()) {
+    done := make(chan struct{})
+    go func() {
+        t := time.NewTicker(interval)
+        defer t.Stop()
+        for {
+            select {
+            case <-t.C:
+                authlite.CullOldKeys()
+                if err := authlite.FlushKeys(); err != nil {
+                    // nothing a background janitor can usefully do about
+                    // this beyond trying again next tick.
+                    continue
+                }
+            case <-done:
+                return
+            }
+        }
+    }()
+    return func() { close(done) }
+}
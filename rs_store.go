@@ -0,0 +1,169 @@
+// rs_store.go
+//
+// An optional resilient on-disk record format for hash_file and
+// key_file. Each CSV record (row) is split into 16 Reed-Solomon shares
+// and encoded out to 48 (32 of them parity), via
+// github.com/vivint/infectious's RS(16,48) implementation. As long as
+// at least 16 of the 48 shares for a given record are intact, the
+// original record can be fully recovered, so a single corrupted disk
+// block can't silently cost us auth data.
+//
+// Enabled with the "resilient_store" Configure() option; composes with
+// the encryption layer in crypt_store.go (a resilient store may also be
+// encrypted, and vice versa - see write_store_file()/read_store_file()).
+//
+// 2020-04-06
+
+package authlite
+
+import( "bytes"; "encoding/binary"; "fmt"; "hash/crc32"; "io";
+        "github.com/vivint/infectious" )
+
+// rs_magic prefixes a resilient-format file.
+var rs_magic = []byte("AUTHLITE-RS1\n")
+
+const rs_required = 16
+const rs_total     = 48
+
+// rs_encode_store() splits plaintext (a complete CSV payload) into
+// records on newline boundaries and RS-encodes each one individually.
+//
+func rs_encode_store(plaintext []byte) []byte {
+    lines := bytes.Split(bytes.TrimRight(plaintext, "\n"), []byte("\n"))
+
+    var out bytes.Buffer
+    out.Write(rs_magic)
+    binary.Write(&out, binary.BigEndian, uint32(len(lines)))
+    for _, line := range lines {
+        out.Write(rs_encode_record(line))
+    }
+    return out.Bytes()
+}
+
+// rs_decode_store() is the inverse of rs_encode_store(): it recovers
+// each record (tolerating up to 32 damaged shares per record) and
+// reassembles the original CSV payload.
+//
+func rs_decode_store(raw []byte) ([]byte, error) {
+    r := bytes.NewReader(raw[len(rs_magic):])
+
+    var n_lines uint32
+    if err := binary.Read(r, binary.BigEndian, &n_lines); err != nil {
+        return nil, fmt.Errorf("truncated resilient store header: %s", err.Error())
+    }
+
+    var out bytes.Buffer
+    for i := uint32(0); i < n_lines; i++ {
+        line, err := rs_decode_record(r)
+        if err != nil {
+            return nil, fmt.Errorf("record %d: %s", i, err.Error())
+        }
+        if i > 0 {
+            out.WriteByte('\n')
+        }
+        out.Write(line)
+    }
+    out.WriteByte('\n')
+    return out.Bytes(), nil
+}
+
+// rs_encode_record() RS(16,48)-encodes a single CSV line, prefixed with
+// its original (un-padded) length and, per share, a CRC32 so a damaged
+// share can be recognized (rather than fed to the decoder as if valid)
+// on the way back in.
+//
+func rs_encode_record(line []byte) []byte {
+    padded_len := rs_padded_len(len(line))
+    padded := make([]byte, padded_len)
+    copy(padded, line)
+
+    fec, err := infectious.NewFEC(rs_required, rs_total)
+    if err != nil {
+        // rs_required/rs_total are compile-time constants; this can't fail.
+        panic(fmt.Sprintf("infectious.NewFEC(%d, %d): %s", rs_required, rs_total, err.Error()))
+    }
+
+    var buf bytes.Buffer
+    binary.Write(&buf, binary.BigEndian, uint32(len(line)))
+    err = fec.Encode(padded, func(s infectious.Share) {
+        buf.WriteByte(byte(s.Number))
+        var crc [4]byte
+        binary.BigEndian.PutUint32(crc[:], share_checksum(byte(s.Number), s.Data))
+        buf.Write(crc[:])
+        buf.Write(s.Data)
+    })
+    if err != nil {
+        panic(fmt.Sprintf("fec.Encode: %s", err.Error()))
+    }
+    return buf.Bytes()
+}
+
+// rs_decode_record() reads one record written by rs_encode_record() from
+// r, discards any share whose CRC doesn't check out, and reconstructs
+// the original line as long as at least rs_required shares survived.
+//
+func rs_decode_record(r io.Reader) ([]byte, error) {
+    var orig_len uint32
+    if err := binary.Read(r, binary.BigEndian, &orig_len); err != nil {
+        return nil, fmt.Errorf("truncated record header: %s", err.Error())
+    }
+    padded_len := rs_padded_len(int(orig_len))
+    share_len  := padded_len / rs_required
+
+    shares := make([]infectious.Share, 0, rs_total)
+    for i := 0; i < rs_total; i++ {
+        var hdr [5]byte
+        if _, err := io.ReadFull(r, hdr[:]); err != nil {
+            return nil, fmt.Errorf("truncated share header: %s", err.Error())
+        }
+        data := make([]byte, share_len)
+        if _, err := io.ReadFull(r, data); err != nil {
+            return nil, fmt.Errorf("truncated share data: %s", err.Error())
+        }
+        number := hdr[0]
+        if share_checksum(number, data) != binary.BigEndian.Uint32(hdr[1:5]) {
+            continue // damaged share (including a corrupted number byte); drop it
+        }
+        if int(number) >= rs_total {
+            // shouldn't happen if the checksum above passed, but infectious
+            // panics on an out-of-range Number, so never hand it one
+            continue
+        }
+        shares = append(shares, infectious.Share{ Number: int(number), Data: data })
+    }
+    if len(shares) < rs_required {
+        return nil, fmt.Errorf("only %d of %d required shares survived", len(shares), rs_required)
+    }
+
+    fec, err := infectious.NewFEC(rs_required, rs_total)
+    if err != nil {
+        return nil, err
+    }
+    rebuilt, err := fec.Decode(nil, shares)
+    if err != nil {
+        return nil, fmt.Errorf("error reconstructing record: %s", err.Error())
+    }
+    return rebuilt[:orig_len], nil
+}
+
+// share_checksum() covers both the share number and its data; checksumming
+// the data alone lets a corrupted number byte slip past undetected and
+// reach infectious.Decode() with an out-of-range Number, which panics.
+//
+func share_checksum(number byte, data []byte) uint32 {
+    h := crc32.NewIEEE()
+    h.Write([]byte{ number })
+    h.Write(data)
+    return h.Sum32()
+}
+
+// rs_padded_len() rounds n up to the next multiple of rs_required (so it
+// can be split into rs_required equal-sized shares), with a floor of
+// rs_required itself for empty records.
+//
+func rs_padded_len(n int) int {
+    if n == 0 {
+        return rs_required
+    }
+    return ((n + rs_required - 1) / rs_required) * rs_required
+}
@@ -0,0 +1,59 @@
+// rs_store_test.go
+//
+// Testing for rs_store.go: a damaged-share round trip, confirming
+// rs_decode_record() reconstructs a record from the Reed-Solomon shares
+// that survive, and still refuses to guess once too few do.
+//
+// 2020-04-06
+
+package authlite
+
+import (
+    "bytes"
+    "testing"
+)
+
+func TestRSDecodeRecordRecoversFromDamagedShares(t *testing.T) {
+    line := []byte("alice,$2a$10$somehashvalue,none,,0")
+    encoded := rs_encode_record(line)
+
+    header_len := 4
+    share_len := rs_padded_len(len(line)) / rs_required
+    share_stride := 5 + share_len
+
+    // Damage more shares than rs_required (16), but fewer than the 32
+    // parity shares available, so recovery should still succeed.
+    damaged := rs_required + 4
+    for i := 0; i < damaged; i++ {
+        data_off := header_len + i*share_stride + 5
+        encoded[data_off] ^= 0xff
+    }
+
+    got, err := rs_decode_record(bytes.NewReader(encoded))
+    if err != nil {
+        t.Fatalf("rs_decode_record(...) returned error after damaging %d/%d shares: %s", damaged, rs_total, err.Error())
+    }
+    if !bytes.Equal(got, line) {
+        t.Errorf("rs_decode_record(...) = %q, want %q", got, line)
+    }
+}
+
+func TestRSDecodeRecordFailsWhenTooFewSharesSurvive(t *testing.T) {
+    line := []byte("bob,$2a$10$otherhash,none,,0")
+    encoded := rs_encode_record(line)
+
+    header_len := 4
+    share_len := rs_padded_len(len(line)) / rs_required
+    share_stride := 5 + share_len
+
+    // One more damaged share than the format can tolerate.
+    damaged := rs_total - rs_required + 1
+    for i := 0; i < damaged; i++ {
+        data_off := header_len + i*share_stride + 5
+        encoded[data_off] ^= 0xff
+    }
+
+    if _, err := rs_decode_record(bytes.NewReader(encoded)); err == nil {
+        t.Errorf("rs_decode_record(...) succeeded despite %d/%d shares damaged, want error", damaged, rs_total)
+    }
+}
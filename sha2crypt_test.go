@@ -0,0 +1,48 @@
+// sha2crypt_test.go
+//
+// Testing for sha2crypt.go, against the canonical $5$/$6$ test vectors
+// from Ulrich Drepper's "Unix crypt using SHA-256 and SHA-512" note.
+//
+// 2020-02-11
+
+package authlite
+
+import "testing"
+
+func TestSha2CryptVerify(t *testing.T) {
+    cases := []struct {
+        pwd    string
+        stored string
+    }{
+        {
+            "Hello world!",
+            "$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5",
+        },
+        {
+            "Hello world!",
+            "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1",
+        },
+    }
+
+    for _, c := range cases {
+        ok, err := sha2crypt_verify(c.stored, c.pwd)
+        if err != nil {
+            t.Errorf("sha2crypt_verify(%q, %q) returned error: %s", c.stored, c.pwd, err.Error())
+            continue
+        }
+        if !ok {
+            t.Errorf("sha2crypt_verify(%q, %q) = false, want true", c.stored, c.pwd)
+        }
+    }
+}
+
+func TestSha2CryptVerifyWrongPassword(t *testing.T) {
+    stored := "$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5"
+    ok, err := sha2crypt_verify(stored, "not the password")
+    if err != nil {
+        t.Errorf("sha2crypt_verify(...) returned error: %s", err.Error())
+    }
+    if ok {
+        t.Errorf("sha2crypt_verify(...) = true for a wrong password, want false")
+    }
+}
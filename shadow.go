@@ -0,0 +1,98 @@
+// shadow.go
+//
+// A ShadowAuthenticator checks passwords against the local system's
+// /etc/shadow, so an operator can configure `auth_backend = shadow` and
+// let authlite delegate password checking to whatever already manages
+// system accounts, while still issuing its own session keys.
+//
+// 2020-02-11
+
+package authlite
+
+import( "bufio"; "fmt"; "io/ioutil"; "os/user"; "strings" )
+
+// ShadowReader supplies the raw contents of a shadow-style file. It
+// exists so ShadowAuthenticator can be unit-tested without reading the
+// real /etc/shadow (which generally requires root).
+//
+type ShadowReader interface {
+    ReadShadow() ([]byte, error)
+}
+
+// fileShadowReader is the default ShadowReader; it reads Path (normally
+// "/etc/shadow").
+//
+type fileShadowReader struct {
+    Path string
+}
+
+func (r fileShadowReader) ReadShadow() ([]byte, error) {
+    return ioutil.ReadFile(r.Path)
+}
+
+// ShadowAuthenticator is an Authenticator that verifies passwords against
+// shadow-style records (the `$5$`/`$6$` crypt formats used by
+// /etc/shadow), after confirming via user.Lookup() that the account
+// exists and isn't locked.
+//
+type ShadowAuthenticator struct {
+    Reader ShadowReader
+}
+
+// new_shadow_authenticator() builds the default ShadowAuthenticator,
+// reading from /etc/shadow.
+//
+func new_shadow_authenticator() *ShadowAuthenticator {
+    return &ShadowAuthenticator{ Reader: fileShadowReader{ Path: "/etc/shadow" } }
+}
+
+// Check() implements Authenticator.
+//
+func (a *ShadowAuthenticator) Check(uname, pwd string) (bool, error) {
+    if _, err := user.Lookup(uname); err != nil {
+        return false, ErrNotAUser
+    }
+
+    raw, err := a.Reader.ReadShadow()
+    if err != nil {
+        return false, fmt.Errorf("error reading shadow data: %s", err.Error())
+    }
+
+    hsh, ok := find_shadow_hash(raw, uname)
+    if !ok {
+        return false, ErrNotAUser
+    }
+    if hsh == "" || hsh == "!" || hsh == "*" || strings.HasPrefix(hsh, "!") {
+        // account has no password set, or is locked/disabled
+        return false, ErrBadPassword
+    }
+    if !strings.HasPrefix(hsh, "$5$") && !strings.HasPrefix(hsh, "$6$") {
+        return false, fmt.Errorf("unsupported shadow hash format for user %q", uname)
+    }
+
+    ok, err = sha2crypt_verify(hsh, pwd)
+    if err != nil {
+        return false, err
+    }
+    if !ok {
+        return false, ErrBadPassword
+    }
+    return true, nil
+}
+
+// find_shadow_hash() scans raw (the contents of a shadow-style file) for
+// the record belonging to uname and returns its password-hash field.
+//
+func find_shadow_hash(raw []byte, uname string) (string, bool) {
+    scanner := bufio.NewScanner(strings.NewReader(string(raw)))
+    for scanner.Scan() {
+        fields := strings.Split(scanner.Text(), ":")
+        if len(fields) < 2 {
+            continue
+        }
+        if fields[0] == uname {
+            return fields[1], true
+        }
+    }
+    return "", false
+}
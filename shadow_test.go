@@ -0,0 +1,96 @@
+// shadow_test.go
+//
+// Testing for shadow.go, using a fake ShadowReader so ShadowAuthenticator
+// can be exercised without touching the real /etc/shadow or requiring
+// root.
+//
+// 2020-02-11
+
+package authlite
+
+import (
+    "fmt"
+    "os/user"
+    "testing"
+)
+
+type fake_shadow_reader struct {
+    data string
+    err  error
+}
+
+func (r fake_shadow_reader) ReadShadow() ([]byte, error) {
+    if r.err != nil {
+        return nil, r.err
+    }
+    return []byte(r.data), nil
+}
+
+func TestShadowAuthenticatorCheck(t *testing.T) {
+    me, err := user.Current()
+    if err != nil {
+        t.Skipf("user.Current() returned error, skipping: %s", err.Error())
+    }
+
+    hsh, err := sha2crypt_rehash("$6$saltstring$", "sekrit")
+    if err != nil {
+        t.Fatalf("sha2crypt_rehash(...) returned error: %s", err.Error())
+    }
+
+    a := &ShadowAuthenticator{
+        Reader: fake_shadow_reader{
+            data: fmt.Sprintf("%s:%s:18000:0:99999:7:::\n", me.Username, hsh),
+        },
+    }
+
+    ok, err := a.Check(me.Username, "sekrit")
+    if err != nil {
+        t.Errorf("Check(%q, \"sekrit\") returned error: %s", me.Username, err.Error())
+    }
+    if !ok {
+        t.Errorf("Check(%q, \"sekrit\") = false, want true", me.Username)
+    }
+
+    ok, err = a.Check(me.Username, "wrong password")
+    if ok {
+        t.Errorf("Check(%q, \"wrong password\") = true, want false", me.Username)
+    }
+    if err != ErrBadPassword {
+        t.Errorf("Check(%q, \"wrong password\") error = %v, want ErrBadPassword", me.Username, err)
+    }
+}
+
+func TestShadowAuthenticatorCheckLockedAccount(t *testing.T) {
+    me, err := user.Current()
+    if err != nil {
+        t.Skipf("user.Current() returned error, skipping: %s", err.Error())
+    }
+
+    a := &ShadowAuthenticator{
+        Reader: fake_shadow_reader{
+            data: fmt.Sprintf("%s:!:18000:0:99999:7:::\n", me.Username),
+        },
+    }
+
+    ok, err := a.Check(me.Username, "whatever")
+    if ok {
+        t.Errorf("Check(...) on a locked account = true, want false")
+    }
+    if err != ErrBadPassword {
+        t.Errorf("Check(...) on a locked account error = %v, want ErrBadPassword", err)
+    }
+}
+
+func TestShadowAuthenticatorCheckUnknownUser(t *testing.T) {
+    a := &ShadowAuthenticator{
+        Reader: fake_shadow_reader{ data: "" },
+    }
+
+    ok, err := a.Check("no-such-user-xyz", "whatever")
+    if ok {
+        t.Errorf("Check(...) for an unknown user = true, want false")
+    }
+    if err != ErrNotAUser {
+        t.Errorf("Check(...) for an unknown user error = %v, want ErrNotAUser", err)
+    }
+}
@@ -0,0 +1,307 @@
+// totp.go
+//
+// Second-factor support (RFC 6238 TOTP and YubiKey OTP) tied to session
+// key issuance. A user's second-factor enrollment is stored alongside
+// their password hash in the hash_file (see the format note above
+// LoadUsers() in authlite.go); CheckPasswordAndIssueKey2FA() is the 2FA
+// counterpart to CheckPasswordAndIssueKey().
+//
+// 2020-03-02
+
+package authlite
+
+import( "crypto/aes"; "crypto/hmac"; "crypto/rand"; "crypto/sha1"; "crypto/subtle";
+        "encoding/base32"; "encoding/binary"; "fmt"; "strconv"; "strings"; "time" )
+
+// mfa holds each user's second-factor enrollment, keyed by username.
+// Protected by umu, same as users, since both live in hash_file.
+var mfa map[string]mfaRecord
+
+// mfaRecord describes a user's enrolled second factor. Method is one of
+// "none", "totp", or "yubikey". For "totp", Secret is the base32-encoded
+// shared secret. For "yubikey", Secret is "<public-id>:<hex AES key>"
+// and Counter is the last-accepted (usage<<8 | session-use) counter value.
+//
+type mfaRecord struct {
+    Method  string
+    Secret  string
+    Counter uint64
+}
+
+// mfa_record_from_fields() builds an mfaRecord from a hash_file CSV row,
+// treating missing trailing fields as an unenrolled ("none") user.
+//
+func mfa_record_from_fields(r []string) mfaRecord {
+    if len(r) < 5 {
+        return mfaRecord{ Method: "none" }
+    }
+    cnt, _ := strconv.ParseUint(r[4], 10, 64)
+    method := r[2]
+    if method == "" {
+        method = "none"
+    }
+    return mfaRecord{ Method: method, Secret: r[3], Counter: cnt }
+}
+
+// mfa_record_to_fields() renders a hash_file CSV row for uname, given
+// their password hash and mfaRecord.
+//
+func mfa_record_to_fields(uname, phash string, rec mfaRecord) []string {
+    return []string{ uname, phash, rec.Method, rec.Secret, fmt.Sprintf("%d", rec.Counter) }
+}
+
+// EnrollTOTP() enrolls uname for TOTP second-factor authentication,
+// generating a new random shared secret (returned base32-encoded, ready
+// to hand to an authenticator app) and persisting the enrollment. Will
+// return ErrNotAUser if uname doesn't exist.
+//
+func EnrollTOTP(uname string) (string, error) {
+    umu.Lock()
+    defer umu.Unlock()
+    if _, exists := users[uname]; !exists {
+        return "", ErrNotAUser
+    }
+
+    raw := make([]byte, 20)
+    if _, err := rand.Read(raw); err != nil {
+        return "", fmt.Errorf("error generating TOTP secret: %s", err.Error())
+    }
+    secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(raw)
+
+    mfa[uname] = mfaRecord{ Method: "totp", Secret: secret }
+    udirty = true
+
+    return secret, nil
+}
+
+// EnrollYubikey() enrolls uname for YubiKey OTP second-factor
+// authentication. pubid is the YubiKey's 12-character modhex public
+// identity, and aes_key is the 16-byte AES key provisioned to that
+// device (e.g. via the YubiKey personalization tool).
+//
+func EnrollYubikey(uname, pubid string, aes_key []byte) error {
+    if len(aes_key) != 16 {
+        return fmt.Errorf("YubiKey AES key must be 16 bytes, got %d", len(aes_key))
+    }
+    umu.Lock()
+    defer umu.Unlock()
+    if _, exists := users[uname]; !exists {
+        return ErrNotAUser
+    }
+
+    secret := fmt.Sprintf("%s:%x", pubid, aes_key)
+    mfa[uname] = mfaRecord{ Method: "yubikey", Secret: secret }
+    udirty = true
+
+    return nil
+}
+
+// CheckPasswordAndIssueKey2FA() checks the username/password combo, then
+// verifies the supplied second-factor code against whatever method
+// uname is enrolled in (if any), issuing a new session key only once
+// both checks pass. If uname has no second factor enrolled ("none"),
+// otp is ignored and this behaves like CheckPasswordAndIssueKey().
+//
+func CheckPasswordAndIssueKey2FA(uname, pwd, otp string) (string, error) {
+    ok, err := CheckPassword(uname, pwd)
+    if !ok {
+        return "", err
+    }
+
+    umu.RLock()
+    rec := mfa[uname]
+    umu.RUnlock()
+
+    switch rec.Method {
+    case "", "none":
+        // no second factor enrolled
+    case "totp":
+        if !check_totp(rec.Secret, otp, time.Now()) {
+            return "", ErrBadPassword
+        }
+    case "yubikey":
+        // Re-check under the write lock (rather than trusting the Counter
+        // we read above) so two concurrent requests replaying the same
+        // OTP can't both pass check_yubikey_otp() against a stale
+        // stored counter and both get issued a key.
+        umu.Lock()
+        rec = mfa[uname]
+        new_counter, ok := check_yubikey_otp(rec.Secret, rec.Counter, otp)
+        if !ok {
+            umu.Unlock()
+            return "", ErrBadPassword
+        }
+        rec.Counter = new_counter
+        mfa[uname] = rec
+        udirty = true
+        umu.Unlock()
+    default:
+        return "", fmt.Errorf("user %q has unrecognized mfa method %q", uname, rec.Method)
+    }
+
+    kstr := generate_key()
+    kmu.Lock()
+    keys[kstr] = key{ uname: uname, until: time.Now().Add(key_lifetime) }
+    kdirty = true
+    kmu.Unlock()
+    return kstr, nil
+}
+
+// check_totp() verifies a 6-digit RFC 6238 TOTP code against secret (a
+// base32-encoded shared secret), allowing the time step before and after
+// the current one to account for clock skew.
+//
+func check_totp(secret, code string, now time.Time) bool {
+    key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+    if err != nil {
+        return false
+    }
+    step := now.Unix() / 30
+    for _, s := range []int64{ step - 1, step, step + 1 } {
+        if subtle.ConstantTimeCompare([]byte(totp_code(key, uint64(s))), []byte(code)) == 1 {
+            return true
+        }
+    }
+    return false
+}
+
+// totp_code() computes the 6-digit HOTP/TOTP code for the given counter
+// value, per RFC 4226 / RFC 6238.
+//
+func totp_code(key []byte, counter uint64) string {
+    var buf [8]byte
+    binary.BigEndian.PutUint64(buf[:], counter)
+
+    h := hmac.New(sha1.New, key)
+    h.Write(buf[:])
+    sum := h.Sum(nil)
+
+    offset := sum[len(sum)-1] & 0x0f
+    bin_code := (uint32(sum[offset]&0x7f) << 24) |
+                (uint32(sum[offset+1]) << 16) |
+                (uint32(sum[offset+2]) << 8) |
+                uint32(sum[offset+3])
+
+    return fmt.Sprintf("%06d", bin_code%1000000)
+}
+
+const yubikey_modhex = "cbdefghijklnrtuv"
+
+// check_yubikey_otp() validates a 44-character modhex YubiKey OTP token
+// against the enrollment Secret ("<pubid>:<hex AES key>") and the
+// last-accepted counter. On success it returns the new counter value to
+// persist; the caller must reject if the returned counter is not
+// strictly greater than the stored one (this function already enforces
+// that, returning ok=false otherwise).
+//
+func check_yubikey_otp(secret string, stored_counter uint64, token string) (uint64, bool) {
+    if len(token) != 44 {
+        return 0, false
+    }
+    parts := strings.SplitN(secret, ":", 2)
+    if len(parts) != 2 {
+        return 0, false
+    }
+    pubid, keyhex := parts[0], parts[1]
+
+    if token[:len(pubid)] != pubid {
+        return 0, false
+    }
+
+    aes_key, err := modhex_to_bytes_via_hex(keyhex)
+    if err != nil {
+        return 0, false
+    }
+
+    ct, err := modhex_decode(token[12:])
+    if err != nil || len(ct) != 16 {
+        return 0, false
+    }
+
+    block, err := aes.NewCipher(aes_key)
+    zero_bytes(aes_key)
+    if err != nil {
+        return 0, false
+    }
+    pt := make([]byte, 16)
+    block.Decrypt(pt, ct)
+    defer zero_bytes(pt)
+
+    if yubikey_crc16(pt) != 0xf0b8 {
+        // checksum residue mismatch; corrupt or garbage token
+        return 0, false
+    }
+
+    // pt layout: 0-5 private id, 6-7 usage counter, 8-10 timestamp,
+    // 11 session-use counter, 12-13 random, 14-15 CRC16.
+    usage_ctr       := binary.LittleEndian.Uint16(pt[6:8])
+    session_use_ctr := pt[11]
+    combined := (uint64(usage_ctr) << 8) | uint64(session_use_ctr)
+
+    if combined <= stored_counter {
+        return 0, false
+    }
+    return combined, true
+}
+
+// zero_bytes() overwrites b with zeroes; used to scrub key material and
+// decrypted OTP plaintext from memory once we're done with them.
+//
+func zero_bytes(b []byte) {
+    for i := range b {
+        b[i] = 0
+    }
+}
+
+// modhex_to_bytes_via_hex() is a helper for decoding the hex-encoded AES
+// key stored by EnrollYubikey(); "via_hex" because, unlike the OTP
+// ciphertext, we store the key as ordinary hex, not modhex.
+//
+func modhex_to_bytes_via_hex(s string) ([]byte, error) {
+    out := make([]byte, len(s)/2)
+    _, err := fmt.Sscanf(s, "%x", &out)
+    if err != nil {
+        return nil, err
+    }
+    return out, nil
+}
+
+// modhex_decode() decodes a YubiKey "modhex" string (an alternate hex
+// alphabet chosen to be keyboard-layout-independent) into raw bytes.
+//
+func modhex_decode(s string) ([]byte, error) {
+    if len(s)%2 != 0 {
+        return nil, fmt.Errorf("odd-length modhex string")
+    }
+    out := make([]byte, len(s)/2)
+    for i := 0; i < len(s); i++ {
+        v := strings.IndexByte(yubikey_modhex, s[i])
+        if v < 0 {
+            return nil, fmt.Errorf("invalid modhex character %q", s[i])
+        }
+        if i%2 == 0 {
+            out[i/2] = byte(v) << 4
+        } else {
+            out[i/2] |= byte(v)
+        }
+    }
+    return out, nil
+}
+
+// yubikey_crc16() computes the CRC-16 variant used by the YubiKey OTP
+// format. A valid decrypted OTP block has a residue of 0xf0b8.
+//
+func yubikey_crc16(data []byte) uint16 {
+    var crc uint16 = 0xffff
+    for _, b := range data {
+        crc ^= uint16(b)
+        for i := 0; i < 8; i++ {
+            if crc&1 != 0 {
+                crc = (crc >> 1) ^ 0x8408
+            } else {
+                crc >>= 1
+            }
+        }
+    }
+    return crc
+}